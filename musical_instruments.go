@@ -1,28 +1,113 @@
 package instruments
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid"
 	pb "github.com/hyperledger/fabric/protos/peer"
 	"log"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// minInstrumentYear bounds the yearMade validation - no instrument in this catalog
+// predates the modern luthier era.
+const minInstrumentYear = 1400
+
+// serialNoPattern restricts serial numbers to the characters real manufacturers use,
+// so they're always safe to embed in composite keys and query selectors.
+var serialNoPattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// instrumentPrivateDetailsCollection is the private data collection holding the
+// sale price, buyer contact, invoice number and notes for an instrument - fields
+// that must not be visible to every member of the channel.
+const instrumentPrivateDetailsCollection = "instrumentPrivateDetails"
+
 type MusicalInstrumentSales struct {
 	methods map[string]func(APIstub shim.ChaincodeStubInterface, args []string) pb.Response
 }
 
 type Instrument struct {
-	Type     string  `json:"type"`
-	Brand    string  `json:"brand"`
-	Model    string  `json:"model"`
-	Color    string  `json:"color"`
-	YearMade int     `json:"yearMade"`
-	Owner    string  `json:"owner"`
-	Price    float64 `json:"price"`
-	SerialNo string  `json:"serialNo"`
+	Type            string  `json:"type"`
+	Brand           string  `json:"brand"`
+	Model           string  `json:"model"`
+	Color           string  `json:"color"`
+	YearMade        int     `json:"yearMade"`
+	Owner           string  `json:"owner"`
+	PendingOwner    string  `json:"pendingOwner,omitempty"`
+	Price           float64 `json:"price"`
+	SerialNo        string  `json:"serialNo"`
+	PrivateDataHash string  `json:"privateDataHash,omitempty"`
+}
+
+// InstrumentPrivateDetails holds the sale details for an instrument that must stay
+// confidential to the transacting organizations. It is never written with PutState -
+// only with PutPrivateData on instrumentPrivateDetailsCollection.
+type InstrumentPrivateDetails struct {
+	Price        float64 `json:"price"`
+	BuyerContact string  `json:"buyerContact"`
+	InvoiceNo    string  `json:"invoiceNumber"`
+	Notes        string  `json:"notes"`
+}
+
+// InstrumentCreatedEvent is emitted by initInstrument so SDK clients can subscribe to
+// new inventory instead of polling for it.
+type InstrumentCreatedEvent struct {
+	SerialNo  string `json:"serialNo"`
+	Owner     string `json:"owner"`
+	Timestamp string `json:"timestamp"`
+}
+
+// InstrumentTransferredEvent is emitted by claimInstrument (and its approveTransfer
+// alias) when the pending owner accepts a transfer. transferInstrument only records the
+// proposal and emits nothing; claimInstrumentPrivate does not emit this event either.
+type InstrumentTransferredEvent struct {
+	SerialNo      string `json:"serialNo"`
+	PreviousOwner string `json:"previousOwner"`
+	NewOwner      string `json:"newOwner"`
+	Timestamp     string `json:"timestamp"`
+}
+
+// InstrumentDeletedEvent is emitted by deleteInstrument when an instrument is removed
+// from the ledger.
+type InstrumentDeletedEvent struct {
+	SerialNo  string `json:"serialNo"`
+	Owner     string `json:"owner"`
+	Timestamp string `json:"timestamp"`
+}
+
+// emitInstrumentEvent stamps payload with the transaction timestamp and calls
+// stub.SetEvent, centralizing the JSON encoding shared by every lifecycle event.
+func emitInstrumentEvent(stub shim.ChaincodeStubInterface, name string, payload interface{}) error {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	timestamp := time.Unix(ts.Seconds, int64(ts.Nanos)).UTC().Format(time.RFC3339)
+
+	switch event := payload.(type) {
+	case InstrumentCreatedEvent:
+		event.Timestamp = timestamp
+		payload = event
+	case InstrumentTransferredEvent:
+		event.Timestamp = timestamp
+		payload = event
+	case InstrumentDeletedEvent:
+		event.Timestamp = timestamp
+		payload = event
+	}
+
+	eventBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(name, eventBytes)
 }
 
 func main() {
@@ -34,10 +119,23 @@ func main() {
 
 func (m *MusicalInstrumentSales) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	m.methods = map[string]func(APIstub shim.ChaincodeStubInterface, args []string) pb.Response{
-		"initInstrument":     m.initInstrument,
-		"transferInstrument": m.transferInstrument,
-		"readInstrument":     m.readInstrument,
-		"deleteInstrument":   m.deleteInstrument,
+		"initInstrument":                 m.initInstrument,
+		"transferInstrument":             m.transferInstrument,
+		"readInstrument":                 m.readInstrument,
+		"deleteInstrument":               m.deleteInstrument,
+		"queryInstrumentsByOwner":        m.queryInstrumentsByOwner,
+		"queryInstrumentsByBrand":        m.queryInstrumentsByBrand,
+		"queryInstrumentsWithPagination": m.queryInstrumentsWithPagination,
+		"getInstrumentsByRange":          m.getInstrumentsByRange,
+		"getInstrumentsByBrandRange":     m.getInstrumentsByBrandRange,
+		"getInstrumentHistory":           m.getInstrumentHistory,
+		"initInstrumentPrivate":          m.initInstrumentPrivate,
+		"readInstrumentPrivateDetails":   m.readInstrumentPrivateDetails,
+		"transferInstrumentPrivate":      m.transferInstrumentPrivate,
+		"claimInstrument":                m.claimInstrument,
+		"approveTransfer":                m.approveTransfer,
+		"claimInstrumentPrivate":         m.claimInstrumentPrivate,
+		"approveTransferPrivate":         m.approveTransferPrivate,
 	}
 	return shim.Success(nil)
 }
@@ -45,61 +143,122 @@ func (m *MusicalInstrumentSales) Init(stub shim.ChaincodeStubInterface) pb.Respo
 func (m *MusicalInstrumentSales) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
 
-	method := m.methods[function]
-	if method != nil {
+	method, ok := m.methods[function]
+	if !ok {
 		log.Println("invoked method not found: " + function)
-		return m.initInstrument(stub, args)
+		return shim.Error("Unknown function invocation: " + function)
 	}
-	return shim.Error("Unknown function invocation")
+	return method(stub, args)
 }
 
-func (m *MusicalInstrumentSales) initInstrument(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var err error
+// parseInstrumentArgs accepts either a single JSON-encoded Instrument in args[0], or
+// the legacy 8 positional arguments (type, brand, model, color, yearMade, owner,
+// price, serialNo), for backward compatibility with existing SDK clients.
+func parseInstrumentArgs(args []string) (*Instrument, error) {
+	if len(args) == 1 {
+		instrument := &Instrument{}
+		if err := json.Unmarshal([]byte(args[0]), instrument); err != nil {
+			return nil, fmt.Errorf("argument must be a JSON-encoded instrument: %v", err)
+		}
+		return instrument, nil
+	}
+
 	if len(args) != 8 {
-		return shim.Error("Incorrect number of arguments. Expecting 8")
+		return nil, fmt.Errorf("Incorrect number of arguments. Expecting a single JSON instrument or 8 positional arguments")
 	}
 	for i := range args {
 		if args[i] == "" {
-			return shim.Error("argument no#" + strconv.Itoa(i+1) + " must be a non-empty string")
+			return nil, fmt.Errorf("argument no#%d must be a non-empty string", i+1)
 		}
 	}
-	typ := args[0]
-	brand := args[1]
-	model := args[2]
-	color := strings.ToLower(args[3])
 	year, err := strconv.Atoi(args[4])
 	if err != nil {
-		return shim.Error("argument 5 must be a numeric string")
+		return nil, fmt.Errorf("argument 5 must be a numeric string")
 	}
-	owner := args[5]
 	price, err := strconv.ParseFloat(args[6], 64)
 	if err != nil {
-		return shim.Error("argument 7 must be a numeric/double string")
+		return nil, fmt.Errorf("argument 7 must be a numeric/double string")
 	}
-	serialNo := args[7]
 
-	instrumentAsBytes, err := stub.GetState(serialNo)
+	return &Instrument{
+		Type:     args[0],
+		Brand:    args[1],
+		Model:    args[2],
+		Color:    args[3],
+		YearMade: year,
+		Owner:    args[5],
+		Price:    price,
+		SerialNo: args[7],
+	}, nil
+}
+
+// validateInstrument centralizes the rules every initInstrument caller must satisfy,
+// regardless of whether it arrived as JSON or positional arguments.
+func validateInstrument(instrument *Instrument, currentYear int) error {
+	if instrument.Type == "" {
+		return fmt.Errorf("type must be a non-empty string")
+	}
+	if instrument.Brand == "" {
+		return fmt.Errorf("brand must be a non-empty string")
+	}
+	if instrument.Model == "" {
+		return fmt.Errorf("model must be a non-empty string")
+	}
+	if instrument.Color == "" {
+		return fmt.Errorf("color must be a non-empty string")
+	}
+	if instrument.Owner == "" {
+		return fmt.Errorf("owner must be a non-empty string")
+	}
+	if instrument.YearMade < minInstrumentYear || instrument.YearMade > currentYear {
+		return fmt.Errorf("yearMade must be between %d and %d", minInstrumentYear, currentYear)
+	}
+	if instrument.Price <= 0 {
+		return fmt.Errorf("price must be a positive number")
+	}
+	if !serialNoPattern.MatchString(instrument.SerialNo) {
+		return fmt.Errorf("serialNo must be a non-empty string of letters, digits and hyphens")
+	}
+	return nil
+}
+
+func (m *MusicalInstrumentSales) initInstrument(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	instrument, err := parseInstrumentArgs(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	instrument.Color = strings.ToLower(instrument.Color)
+
+	// Owner is always the identity submitting this transaction, never a caller-supplied
+	// value, so isAuthorizedOwner can trust it holds a genuine "mspID/enrollmentID"
+	// string for every instrument on the ledger, not just ones created by convention.
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to identify caller: " + err.Error())
+	}
+	instrument.Owner = caller
+
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	currentYear := time.Unix(ts.Seconds, int64(ts.Nanos)).UTC().Year()
+	if err := validateInstrument(instrument, currentYear); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	instrumentAsBytes, err := stub.GetState(instrument.SerialNo)
 	if err != nil {
 		return shim.Error("Failed to get instrument: " + err.Error())
 	} else if instrumentAsBytes != nil {
-		fmt.Println("This instrument already exists: " + model)
-		return shim.Error("This instrument already exists: " + model)
-	}
-	instrument := &Instrument{
-		typ,
-		brand,
-		model,
-		color,
-		year,
-		owner,
-		price,
-		serialNo,
+		fmt.Println("This instrument already exists: " + instrument.Model)
+		return shim.Error("This instrument already exists: " + instrument.Model)
 	}
 	instrumentJSONasBytes, err := json.Marshal(instrument)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	err = stub.PutState(serialNo, instrumentJSONasBytes)
+	err = stub.PutState(instrument.SerialNo, instrumentJSONasBytes)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -111,6 +270,13 @@ func (m *MusicalInstrumentSales) initInstrument(stub shim.ChaincodeStubInterface
 	}
 	value := []byte{0x00}
 	stub.PutState(colorNameIndexKey, value)
+
+	if err := emitInstrumentEvent(stub, "InstrumentCreated", InstrumentCreatedEvent{
+		SerialNo: instrument.SerialNo,
+		Owner:    instrument.Owner,
+	}); err != nil {
+		return shim.Error("Failed to emit event: " + err.Error())
+	}
 	return shim.Success(nil)
 }
 
@@ -156,6 +322,13 @@ func (m *MusicalInstrumentSales) deleteInstrument(stub shim.ChaincodeStubInterfa
 		return shim.Error(jsonResp)
 	}
 
+	authorized, err := isAuthorizedOwner(stub, instrumentJSON.Owner)
+	if err != nil {
+		return shim.Error("Failed to verify submitting client identity: " + err.Error())
+	} else if !authorized {
+		return shim.Error("submitting client is not authorized to delete this instrument")
+	}
+
 	err = stub.DelState(serialNo)
 	if err != nil {
 		return shim.Error("Failed to delete state:" + err.Error())
@@ -171,9 +344,20 @@ func (m *MusicalInstrumentSales) deleteInstrument(stub shim.ChaincodeStubInterfa
 	if err != nil {
 		return shim.Error("Failed to delete state:" + err.Error())
 	}
+
+	if err := emitInstrumentEvent(stub, "InstrumentDeleted", InstrumentDeletedEvent{
+		SerialNo: serialNo,
+		Owner:    instrumentJSON.Owner,
+	}); err != nil {
+		return shim.Error("Failed to emit event: " + err.Error())
+	}
 	return shim.Success(nil)
 }
 
+// transferInstrument proposes handing an instrument to newOwner, an identity string
+// in "mspID/enrollmentID" form. Only the current owner (or a channel admin) may
+// propose a transfer, and ownership does not actually move until newOwner submits
+// claimInstrument (or its approveTransfer alias) to accept.
 func (m *MusicalInstrumentSales) transferInstrument(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	if len(args) < 2 {
@@ -181,7 +365,7 @@ func (m *MusicalInstrumentSales) transferInstrument(stub shim.ChaincodeStubInter
 	}
 
 	serialNo := args[0]
-	newOwner := strings.ToLower(args[1])
+	newOwner := args[1]
 
 	instrumentAsBytes, err := stub.GetState(serialNo)
 	if err != nil {
@@ -195,7 +379,15 @@ func (m *MusicalInstrumentSales) transferInstrument(stub shim.ChaincodeStubInter
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	instrumentToTransfer.Owner = newOwner
+
+	authorized, err := isAuthorizedOwner(stub, instrumentToTransfer.Owner)
+	if err != nil {
+		return shim.Error("Failed to verify submitting client identity: " + err.Error())
+	} else if !authorized {
+		return shim.Error("submitting client is not authorized to transfer this instrument")
+	}
+
+	instrumentToTransfer.PendingOwner = newOwner
 
 	instrumentJSONasBytes, _ := json.Marshal(instrumentToTransfer)
 	err = stub.PutState(serialNo, instrumentJSONasBytes)
@@ -204,3 +396,710 @@ func (m *MusicalInstrumentSales) transferInstrument(stub shim.ChaincodeStubInter
 	}
 	return shim.Success(nil)
 }
+
+// claimInstrument completes a transfer proposed by transferInstrument. The submitting
+// client must be the pending owner recorded on the instrument; on success Owner is
+// updated, PendingOwner is cleared, and an InstrumentTransferred event is emitted.
+func (m *MusicalInstrumentSales) claimInstrument(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting serial number")
+	}
+	serialNo := args[0]
+
+	instrumentAsBytes, err := stub.GetState(serialNo)
+	if err != nil {
+		return shim.Error("Failed to get instrument:" + err.Error())
+	} else if instrumentAsBytes == nil {
+		return shim.Error("Instrument does not exist")
+	}
+
+	instrument := Instrument{}
+	if err := json.Unmarshal(instrumentAsBytes, &instrument); err != nil {
+		return shim.Error(err.Error())
+	}
+	if instrument.PendingOwner == "" {
+		return shim.Error("this instrument has no pending transfer to claim")
+	}
+
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to verify submitting client identity: " + err.Error())
+	} else if caller != instrument.PendingOwner {
+		return shim.Error("submitting client is not the pending owner of this instrument")
+	}
+
+	previousOwner := instrument.Owner
+	instrument.Owner = instrument.PendingOwner
+	instrument.PendingOwner = ""
+
+	instrumentJSONasBytes, err := json.Marshal(instrument)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.PutState(serialNo, instrumentJSONasBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := emitInstrumentEvent(stub, "InstrumentTransferred", InstrumentTransferredEvent{
+		SerialNo:      serialNo,
+		PreviousOwner: previousOwner,
+		NewOwner:      instrument.Owner,
+	}); err != nil {
+		return shim.Error("Failed to emit event: " + err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// approveTransfer is the same handshake as claimInstrument, kept as a second entry
+// point for SDK clients that model the acceptance step as an "approval" rather than a
+// "claim".
+func (m *MusicalInstrumentSales) approveTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return m.claimInstrument(stub, args)
+}
+
+// queryInstrumentsByOwner returns every instrument currently held by the given owner,
+// using a CouchDB rich query selector. Requires CouchDB as the state database.
+func (m *MusicalInstrumentSales) queryInstrumentsByOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting owner")
+	}
+	owner := args[0]
+	queryString, err := buildEqualitySelector("owner", owner)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+// queryInstrumentsByBrand returns every instrument of the given brand, using a CouchDB
+// rich query selector. Requires CouchDB as the state database.
+func (m *MusicalInstrumentSales) queryInstrumentsByBrand(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting brand")
+	}
+	brand := args[0]
+	queryString, err := buildEqualitySelector("brand", brand)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(queryResults)
+}
+
+// queryInstrumentsWithPagination runs an arbitrary CouchDB selector with paging, so
+// clients can page through large result sets instead of fetching everything at once.
+// args: queryString, pageSize, bookmark (bookmark may be empty for the first page).
+func (m *MusicalInstrumentSales) queryInstrumentsWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting queryString, pageSize, bookmark")
+	}
+	queryString := args[0]
+	pageSize, err := strconv.Atoi(args[1])
+	if err != nil {
+		return shim.Error("pageSize must be a numeric string")
+	}
+	bookmark := args[2]
+
+	resultsIterator, responseMetadata, err := stub.GetQueryResultWithPagination(queryString, int32(pageSize), bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	results, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString("{\"Results\":")
+	buffer.Write(results.Bytes())
+	buffer.WriteString(", \"ResponseMetadata\":{\"RecordsCount\":")
+	buffer.WriteString(strconv.Itoa(int(responseMetadata.FetchedRecordsCount)))
+	buffer.WriteString(", \"Bookmark\":\"")
+	buffer.WriteString(responseMetadata.Bookmark)
+	buffer.WriteString("\"}}")
+
+	return shim.Success(buffer.Bytes())
+}
+
+// getInstrumentsByRange returns every instrument whose serial number falls in
+// [startKey, endKey), using a plain range scan over the raw ledger key space.
+func (m *MusicalInstrumentSales) getInstrumentsByRange(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting startKey, endKey")
+	}
+	startKey := args[0]
+	endKey := args[1]
+
+	resultsIterator, err := stub.GetStateByRange(startKey, endKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(buffer.Bytes())
+}
+
+// getInstrumentsByBrandRange returns every instrument for the given brand using the
+// brand~serialNo composite index, avoiding a full scan or a CouchDB-only rich query.
+func (m *MusicalInstrumentSales) getInstrumentsByBrandRange(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting brand")
+	}
+	brand := args[0]
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("brand~serialNo", []string{brand})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	bArrayMemberAlreadyWritten := false
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if len(compositeKeyParts) < 2 {
+			continue
+		}
+		serialNo := compositeKeyParts[1]
+
+		instrumentAsBytes, err := stub.GetState(serialNo)
+		if err != nil {
+			return shim.Error("Failed to get instrument: " + err.Error())
+		} else if instrumentAsBytes == nil {
+			continue
+		}
+
+		if bArrayMemberAlreadyWritten {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString("{\"Key\":\"")
+		buffer.WriteString(serialNo)
+		buffer.WriteString("\", \"Record\":")
+		buffer.WriteString(string(instrumentAsBytes))
+		buffer.WriteString("}")
+		bArrayMemberAlreadyWritten = true
+	}
+	buffer.WriteString("]")
+
+	return shim.Success(buffer.Bytes())
+}
+
+// buildEqualitySelector JSON-encodes a single-field equality selector, e.g.
+// {"selector":{"owner":"alice"}}. Building it via json.Marshal instead of string
+// formatting keeps a value containing a quote or backslash from breaking out of the
+// selector and injecting arbitrary query clauses.
+func buildEqualitySelector(field, value string) (string, error) {
+	selector := map[string]interface{}{
+		"selector": map[string]string{field: value},
+	}
+	selectorBytes, err := json.Marshal(selector)
+	if err != nil {
+		return "", err
+	}
+	return string(selectorBytes), nil
+}
+
+// getQueryResultForQueryString runs a CouchDB rich query selector and returns the
+// matching results as a JSON array of {Key, Record} entries.
+func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString string) ([]byte, error) {
+	resultsIterator, err := stub.GetQueryResult(queryString)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// constructQueryResponseFromIterator drains a state query iterator into a JSON array
+// of {Key, Record} entries, shared by getInstrumentsByRange and the rich-query based
+// Invoke methods. getInstrumentsByBrandRange builds its own array.
+func constructQueryResponseFromIterator(resultsIterator shim.StateQueryIteratorInterface) (*bytes.Buffer, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	bArrayMemberAlreadyWritten := false
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if bArrayMemberAlreadyWritten {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString("{\"Key\":\"")
+		buffer.WriteString(queryResponse.Key)
+		buffer.WriteString("\", \"Record\":")
+		buffer.WriteString(string(queryResponse.Value))
+		buffer.WriteString("}")
+		bArrayMemberAlreadyWritten = true
+	}
+	buffer.WriteString("]")
+
+	return &buffer, nil
+}
+
+// InstrumentHistoryRecord captures a single entry of an instrument's ledger history,
+// as returned by getInstrumentHistory.
+type InstrumentHistoryRecord struct {
+	TxId      string      `json:"txId"`
+	Timestamp string      `json:"timestamp"`
+	IsDelete  bool        `json:"isDelete"`
+	Value     *Instrument `json:"value"`
+}
+
+// getInstrumentHistory returns the full chain-of-custody for an instrument - every
+// PutState/DelState ever recorded for its serial number - so clients can audit past
+// ownership transfers and price changes rather than only seeing the latest state.
+func (m *MusicalInstrumentSales) getInstrumentHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting serial number of the instrument to query")
+	}
+	serialNo := args[0]
+
+	resultsIterator, err := stub.GetHistoryForKey(serialNo)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	var records []InstrumentHistoryRecord
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		var instrument *Instrument
+		if !response.IsDelete {
+			instrument = &Instrument{}
+			if err := json.Unmarshal(response.Value, instrument); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+
+		records = append(records, InstrumentHistoryRecord{
+			TxId:      response.TxId,
+			Timestamp: time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).UTC().Format(time.RFC3339),
+			IsDelete:  response.IsDelete,
+			Value:     instrument,
+		})
+	}
+
+	recordsAsBytes, err := json.Marshal(records)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(recordsAsBytes)
+}
+
+// instrumentPrivateInput is the transient-only payload for initInstrumentPrivate: the
+// public instrument fields plus the confidential sale details, submitted together so
+// the sensitive portion never appears in the transaction proposal or block.
+type instrumentPrivateInput struct {
+	Type         string  `json:"type"`
+	Brand        string  `json:"brand"`
+	Model        string  `json:"model"`
+	Color        string  `json:"color"`
+	YearMade     int     `json:"yearMade"`
+	Owner        string  `json:"owner"`
+	SerialNo     string  `json:"serialNo"`
+	Price        float64 `json:"price"`
+	BuyerContact string  `json:"buyerContact"`
+	InvoiceNo    string  `json:"invoiceNumber"`
+	Notes        string  `json:"notes"`
+}
+
+// getCreatorMSPID resolves the MSP identity of the client submitting the current
+// transaction. No method in this chaincode calls it at present.
+func getCreatorMSPID(stub shim.ChaincodeStubInterface) (string, error) {
+	identity, err := cid.New(stub)
+	if err != nil {
+		return "", err
+	}
+	return identity.GetMSPID()
+}
+
+// callerIdentity builds the "mspID/enrollmentID" string that uniquely identifies the
+// client submitting the current transaction. This is the canonical form in which
+// Instrument.Owner and Instrument.PendingOwner are now stored and compared.
+func callerIdentity(stub shim.ChaincodeStubInterface) (string, error) {
+	identity, err := cid.New(stub)
+	if err != nil {
+		return "", err
+	}
+	mspID, err := identity.GetMSPID()
+	if err != nil {
+		return "", err
+	}
+	enrollmentID, err := identity.GetID()
+	if err != nil {
+		return "", err
+	}
+	return mspID + "/" + enrollmentID, nil
+}
+
+// callerIsAdmin reports whether the submitting client's certificate carries an
+// "admin" attribute set to "true", letting channel administrators override ownership
+// checks (e.g. to correct a stuck transfer) without impersonating the owner.
+func callerIsAdmin(stub shim.ChaincodeStubInterface) (bool, error) {
+	identity, err := cid.New(stub)
+	if err != nil {
+		return false, err
+	}
+	value, found, err := identity.GetAttributeValue("admin")
+	if err != nil {
+		return false, err
+	}
+	return found && value == "true", nil
+}
+
+// isAuthorizedOwner reports whether the submitting client is either the recorded
+// owner or a channel admin, the access rule shared by transferInstrument and
+// deleteInstrument.
+func isAuthorizedOwner(stub shim.ChaincodeStubInterface, owner string) (bool, error) {
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return false, err
+	}
+	if caller == owner {
+		return true, nil
+	}
+	return callerIsAdmin(stub)
+}
+
+// initInstrumentPrivate creates an instrument whose public state holds only type,
+// brand, model, color, yearMade, serialNo, owner and a SHA-256 hash of the private
+// details (its public price is left at zero), while price, buyer contact, invoice
+// number and notes are stored separately on instrumentPrivateDetailsCollection.
+// The full payload must arrive via the transient map under the key "instrument" so the
+// private fields never land in the proposal or on the ledger's public side.
+func (m *MusicalInstrumentSales) initInstrumentPrivate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	transMap, err := stub.GetTransient()
+	if err != nil {
+		return shim.Error("Error getting transient: " + err.Error())
+	}
+	instrumentJSONBytes, ok := transMap["instrument"]
+	if !ok {
+		return shim.Error("instrument must be a key in the transient map")
+	}
+	if len(instrumentJSONBytes) == 0 {
+		return shim.Error("instrument value in the transient map must be a non-empty JSON string")
+	}
+
+	var input instrumentPrivateInput
+	if err := json.Unmarshal(instrumentJSONBytes, &input); err != nil {
+		return shim.Error("Failed to decode JSON of instrument: " + err.Error())
+	}
+	input.Color = strings.ToLower(input.Color)
+
+	// Owner is always the identity submitting this transaction, never a caller-supplied
+	// value, matching initInstrument and keeping the ownership-based authorization model
+	// valid for every instrument, public or private.
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to identify caller: " + err.Error())
+	}
+	input.Owner = caller
+
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	currentYear := time.Unix(ts.Seconds, int64(ts.Nanos)).UTC().Year()
+	validationInstrument := Instrument{
+		Type:     input.Type,
+		Brand:    input.Brand,
+		Model:    input.Model,
+		Color:    input.Color,
+		YearMade: input.YearMade,
+		Owner:    input.Owner,
+		Price:    input.Price,
+		SerialNo: input.SerialNo,
+	}
+	if err := validateInstrument(&validationInstrument, currentYear); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	existing, err := stub.GetState(input.SerialNo)
+	if err != nil {
+		return shim.Error("Failed to get instrument: " + err.Error())
+	} else if existing != nil {
+		return shim.Error("This instrument already exists: " + input.SerialNo)
+	}
+
+	private := InstrumentPrivateDetails{
+		Price:        input.Price,
+		BuyerContact: input.BuyerContact,
+		InvoiceNo:    input.InvoiceNo,
+		Notes:        input.Notes,
+	}
+	privateBytes, err := json.Marshal(private)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	hash := sha256.Sum256(privateBytes)
+
+	instrument := Instrument{
+		Type:            input.Type,
+		Brand:           input.Brand,
+		Model:           input.Model,
+		Color:           input.Color,
+		YearMade:        input.YearMade,
+		Owner:           input.Owner,
+		SerialNo:        input.SerialNo,
+		PrivateDataHash: hex.EncodeToString(hash[:]),
+	}
+	instrumentBytes, err := json.Marshal(instrument)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.PutState(input.SerialNo, instrumentBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	indexName := "brand~serialNo"
+	brandSerialNoIndexKey, err := stub.CreateCompositeKey(indexName, []string{instrument.Brand, instrument.SerialNo})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.PutState(brandSerialNoIndexKey, []byte{0x00}); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := stub.PutPrivateData(instrumentPrivateDetailsCollection, input.SerialNo, privateBytes); err != nil {
+		return shim.Error("Failed to put private details: " + err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// readInstrumentPrivateDetails returns the confidential sale details for an
+// instrument. The submitting client must be the current owner, the pending owner of
+// an in-flight transfer, or a channel admin (transferInstrumentPrivate admits only the
+// current owner or a channel admin) - otherwise the instrumentPrivateDetailsCollection policy
+// alone is not enough to stop an authorized channel member from reading someone
+// else's price/buyer/invoice data.
+func (m *MusicalInstrumentSales) readInstrumentPrivateDetails(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting serial number of the instrument to query")
+	}
+	serialNo := args[0]
+	if strings.HasSuffix(serialNo, pendingPrivateDetailsSuffix) {
+		return shim.Error("not a valid instrument serial number")
+	}
+
+	instrumentAsBytes, err := stub.GetState(serialNo)
+	if err != nil {
+		return shim.Error("Failed to get instrument: " + err.Error())
+	} else if instrumentAsBytes == nil {
+		return shim.Error("Instrument does not exist: " + serialNo)
+	}
+
+	instrument := Instrument{}
+	if err := json.Unmarshal(instrumentAsBytes, &instrument); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	authorized, err := isAuthorizedOwner(stub, instrument.Owner)
+	if err != nil {
+		return shim.Error("Failed to verify submitting client identity: " + err.Error())
+	}
+	if !authorized && instrument.PendingOwner != "" {
+		caller, err := callerIdentity(stub)
+		if err != nil {
+			return shim.Error("Failed to verify submitting client identity: " + err.Error())
+		}
+		authorized = caller == instrument.PendingOwner
+	}
+	if !authorized {
+		return shim.Error("submitting client is not authorized to read this instrument's private details")
+	}
+
+	privateBytes, err := stub.GetPrivateData(instrumentPrivateDetailsCollection, serialNo)
+	if err != nil {
+		return shim.Error("Failed to get private details: " + err.Error())
+	} else if privateBytes == nil {
+		return shim.Error("Private details do not exist for: " + serialNo)
+	}
+	return shim.Success(privateBytes)
+}
+
+// pendingPrivateDetailsSuffix marks the instrumentPrivateDetailsCollection key under
+// which transferInstrumentPrivate stashes the proposed sale details until the pending
+// owner claims them - it must never collide with a real serial number.
+const pendingPrivateDetailsSuffix = "~pending"
+
+func pendingPrivateDetailsKey(serialNo string) string {
+	return serialNo + pendingPrivateDetailsSuffix
+}
+
+// transferInstrumentPrivate proposes transferring a privately-detailed instrument,
+// along with new confidential sale details (price, buyer contact, invoice number,
+// notes) submitted via the transient map under the key "instrument_owner". Only the
+// current owner (or a channel admin) may propose. Ownership and the private details
+// do not actually move until the pending owner submits claimInstrumentPrivate (or its
+// approveTransferPrivate alias) to accept.
+func (m *MusicalInstrumentSales) transferInstrumentPrivate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting serial number")
+	}
+	serialNo := args[0]
+
+	transMap, err := stub.GetTransient()
+	if err != nil {
+		return shim.Error("Error getting transient: " + err.Error())
+	}
+	transientBytes, ok := transMap["instrument_owner"]
+	if !ok {
+		return shim.Error("instrument_owner must be a key in the transient map")
+	}
+
+	var input struct {
+		Owner        string  `json:"owner"`
+		Price        float64 `json:"price"`
+		BuyerContact string  `json:"buyerContact"`
+		InvoiceNo    string  `json:"invoiceNumber"`
+		Notes        string  `json:"notes"`
+	}
+	if err := json.Unmarshal(transientBytes, &input); err != nil {
+		return shim.Error("Failed to decode JSON of instrument_owner: " + err.Error())
+	}
+	if input.Owner == "" {
+		return shim.Error("owner must be a non-empty string")
+	}
+
+	instrumentAsBytes, err := stub.GetState(serialNo)
+	if err != nil {
+		return shim.Error("Failed to get instrument: " + err.Error())
+	} else if instrumentAsBytes == nil {
+		return shim.Error("Instrument does not exist")
+	}
+
+	instrument := Instrument{}
+	if err := json.Unmarshal(instrumentAsBytes, &instrument); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	authorized, err := isAuthorizedOwner(stub, instrument.Owner)
+	if err != nil {
+		return shim.Error("Failed to verify submitting client identity: " + err.Error())
+	} else if !authorized {
+		return shim.Error("submitting client is not authorized to transfer this instrument")
+	}
+
+	pendingPrivate := InstrumentPrivateDetails{
+		Price:        input.Price,
+		BuyerContact: input.BuyerContact,
+		InvoiceNo:    input.InvoiceNo,
+		Notes:        input.Notes,
+	}
+	pendingPrivateBytes, err := json.Marshal(pendingPrivate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.PutPrivateData(instrumentPrivateDetailsCollection, pendingPrivateDetailsKey(serialNo), pendingPrivateBytes); err != nil {
+		return shim.Error("Failed to put pending private details: " + err.Error())
+	}
+
+	instrument.PendingOwner = input.Owner
+	instrumentBytes, err := json.Marshal(instrument)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.PutState(serialNo, instrumentBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// claimInstrumentPrivate completes a transfer proposed by transferInstrumentPrivate.
+// The submitting client must be the pending owner recorded on the instrument; on
+// success Owner is updated, PendingOwner is cleared, and the pending sale details
+// become the instrument's confidential record.
+func (m *MusicalInstrumentSales) claimInstrumentPrivate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting serial number")
+	}
+	serialNo := args[0]
+
+	instrumentAsBytes, err := stub.GetState(serialNo)
+	if err != nil {
+		return shim.Error("Failed to get instrument: " + err.Error())
+	} else if instrumentAsBytes == nil {
+		return shim.Error("Instrument does not exist")
+	}
+
+	instrument := Instrument{}
+	if err := json.Unmarshal(instrumentAsBytes, &instrument); err != nil {
+		return shim.Error(err.Error())
+	}
+	if instrument.PendingOwner == "" {
+		return shim.Error("this instrument has no pending transfer to claim")
+	}
+
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return shim.Error("Failed to verify submitting client identity: " + err.Error())
+	} else if caller != instrument.PendingOwner {
+		return shim.Error("submitting client is not the pending owner of this instrument")
+	}
+
+	pendingPrivateBytes, err := stub.GetPrivateData(instrumentPrivateDetailsCollection, pendingPrivateDetailsKey(serialNo))
+	if err != nil {
+		return shim.Error("Failed to get pending private details: " + err.Error())
+	} else if pendingPrivateBytes == nil {
+		return shim.Error("no pending private details found for: " + serialNo)
+	}
+	hash := sha256.Sum256(pendingPrivateBytes)
+
+	instrument.Owner = instrument.PendingOwner
+	instrument.PendingOwner = ""
+	instrument.PrivateDataHash = hex.EncodeToString(hash[:])
+	instrumentBytes, err := json.Marshal(instrument)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err := stub.PutState(serialNo, instrumentBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err := stub.PutPrivateData(instrumentPrivateDetailsCollection, serialNo, pendingPrivateBytes); err != nil {
+		return shim.Error("Failed to put private details: " + err.Error())
+	}
+	if err := stub.DelPrivateData(instrumentPrivateDetailsCollection, pendingPrivateDetailsKey(serialNo)); err != nil {
+		return shim.Error("Failed to clear pending private details: " + err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// approveTransferPrivate is the same handshake as claimInstrumentPrivate, kept as a
+// second entry point for SDK clients that model the acceptance step as an "approval"
+// rather than a "claim", matching approveTransfer on the public path.
+func (m *MusicalInstrumentSales) approveTransferPrivate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return m.claimInstrumentPrivate(stub, args)
+}